@@ -87,6 +87,23 @@ func (categories *Categories) ToDto() *CategoriesDto {
 	return &categories.CategoriesDto
 }
 
+// Add merges other's bucket values and total size into c. It exists
+// alongside Categories.AddTo for callers - such as categoryRollup, which
+// accumulates the per-directory deltas upsertFileBatch records - that work
+// with a CategoriesDto value directly rather than a live Categories
+// accumulator.
+func (c *CategoriesDto) Add(other CategoriesDto) {
+	if len(c.Values) == 0 {
+		c.Values = newCategoryValues()
+	}
+	for ages := 0; ages < len(BoundsAges); ages++ {
+		for sizes := 0; sizes < len(BoundsSizes); sizes++ {
+			c.Values[ages][sizes] += other.Values[ages][sizes]
+		}
+	}
+	c.TotalSize += other.TotalSize
+}
+
 // adds the lower entry into this category
 func (categories *Categories) AddTo(lower *Categories) {
 	// loop through the ages
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"github.com/arangodb/go-driver"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// CategoryFlushCount is the number of accumulated per-directory
+	// deltas after which the rollup batch is flushed early, ahead of the
+	// periodic CategoryFlushInterval tick.
+	CategoryFlushCount = 256
+	// CategoryFlushInterval bounds how stale the directory/subtree
+	// category counters can get under light, bursty ingest.
+	CategoryFlushInterval = 500 * time.Millisecond
+)
+
+// categoryRollup batches the per-directory category deltas produced by
+// processFilePayload so that a burst of file inserts under one directory
+// results in one ArangoDB UPDATE per ancestor per flush, rather than one per
+// file. It is safe for concurrent use by every processFilePayload worker.
+type categoryRollup struct {
+	mu      sync.Mutex
+	own     map[string]CategoriesDto
+	subtree map[string]CategoriesDto
+	pending int
+}
+
+func newCategoryRollup() *categoryRollup {
+	return &categoryRollup{
+		own:     make(map[string]CategoriesDto),
+		subtree: make(map[string]CategoriesDto),
+	}
+}
+
+// record accumulates delta against ownKey's own categories and against the
+// subtree categories of ownKey and every one of its ancestors (resolved
+// from ownPath, ownKey's directory), returning true once enough deltas have
+// queued up to warrant an out-of-band flush.
+func (r *categoryRollup) record(ownKey, ownPath string, delta CategoriesDto) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	addDelta(r.own, ownKey, delta)
+	addDelta(r.subtree, ownKey, delta)
+	for _, ancestorKey := range ancestorChain(ownPath) {
+		addDelta(r.subtree, ancestorKey, delta)
+	}
+
+	r.pending++
+	if r.pending >= CategoryFlushCount {
+		r.pending = 0
+		return true
+	}
+	return false
+}
+
+func addDelta(deltas map[string]CategoriesDto, key string, delta CategoriesDto) {
+	acc := deltas[key]
+	acc.Add(delta)
+	deltas[key] = acc
+}
+
+// flush applies and clears every pending delta. Individual failures are
+// logged rather than fatal: a failed update's delta is queued again, so it
+// just makes one node's counters briefly stale until the next flush applies
+// it. A delta that fails in the final flush on shutdown is not retried.
+func (r *categoryRollup) flush() {
+	r.mu.Lock()
+	own := r.own
+	subtree := r.subtree
+	r.own = make(map[string]CategoriesDto)
+	r.subtree = make(map[string]CategoriesDto)
+	r.pending = 0
+	r.mu.Unlock()
+
+	for key, delta := range own {
+		if err := bumpDirectoryCategories(key, "ownCategories", delta); err != nil {
+			log.Printf("failed rolling up own categories for %v: %v\n", key, err)
+			r.mu.Lock()
+			addDelta(r.own, key, delta)
+			r.mu.Unlock()
+		}
+	}
+	for key, delta := range subtree {
+		if err := bumpDirectoryCategories(key, "subtreeCategories", delta); err != nil {
+			log.Printf("failed rolling up subtree categories for %v: %v\n", key, err)
+			r.mu.Lock()
+			addDelta(r.subtree, key, delta)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// runFlushLoop periodically flushes r until stop is signalled.
+func (r *categoryRollup) runFlushLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(CategoryFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-stop:
+			r.flush()
+			return
+		}
+	}
+}
+
+// bumpDirectoryCategories atomically merges delta into the named
+// categories field ("ownCategories" or "subtreeCategories") of the
+// directory with the given key. The read-modify-write happens inside a
+// single AQL UPDATE, which ArangoDB executes atomically per document, so
+// concurrent flushes touching the same directory never lose an increment.
+func bumpDirectoryCategories(key string, field string, delta CategoriesDto) error {
+	query := `
+FOR d IN directories FILTER d._key == @key
+UPDATE d WITH {
+  [@field]: {
+    values: (FOR row IN 0..LENGTH(@delta.values)-1
+             RETURN (FOR col IN 0..LENGTH(@delta.values[row])-1
+                     RETURN (d[@field].values[row][col] == null ? 0 : d[@field].values[row][col]) + @delta.values[row][col])),
+    totalsizes: (d[@field].totalsizes == null ? 0 : d[@field].totalsizes) + @delta.totalsizes
+  }
+} IN directories
+`
+	bindVars := map[string]interface{}{"key": key, "field": field, "delta": delta}
+	cursor, err := db.Query(nil, query, bindVars)
+	if err != nil {
+		return err
+	}
+	return cursor.Close()
+}
+
+// directoryMeta resolves path's DocumentMeta via the LRU cache, falling
+// back to a graph lookup on a miss - the same pattern processDirectoryPayload
+// and processFilePayload already use to find a parent directory.
+func directoryMeta(path string) (driver.DocumentMeta, bool) {
+	if value := lruDirectoryCache.Get(path); value != nil {
+		return *(value.Value().(*driver.DocumentMeta)), true
+	}
+	if db == nil {
+		// without a database connection only the cache can resolve path
+		return driver.DocumentMeta{}, false
+	}
+	_, meta, err := getDirectory(nil, path)
+	if err != nil {
+		return driver.DocumentMeta{}, false
+	}
+	lruDirectoryCache.Set(path, &meta, time.Hour*24)
+	return meta, true
+}
+
+// ancestorChain returns the directory keys from path's parent up to the
+// root, stopping at the first ancestor it cannot resolve.
+func ancestorChain(path string) []string {
+	var keys []string
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return keys
+		}
+		meta, ok := directoryMeta(parent)
+		if !ok {
+			return keys
+		}
+		keys = append(keys, meta.Key)
+		path = parent
+	}
+}
+
+// subtractAncestorCategories removes deleted's categories from every
+// ancestor of path (but not path itself, which the caller is about to
+// delete), keeping their SubtreeCategories roll-ups correct after a prune.
+func subtractAncestorCategories(path string, deleted CategoriesDto) {
+	negated := CategoriesDto{Values: newCategoryValues(), TotalSize: -deleted.TotalSize}
+	for ages := range deleted.Values {
+		for sizes := range deleted.Values[ages] {
+			negated.Values[ages][sizes] = -deleted.Values[ages][sizes]
+		}
+	}
+	for _, key := range ancestorChain(path) {
+		if err := bumpDirectoryCategories(key, "subtreeCategories", negated); err != nil {
+			log.Printf("failed subtracting categories for ancestor %v of %v: %v\n", key, path, err)
+		}
+	}
+}
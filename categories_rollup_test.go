@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/arangodb/go-driver"
+	"testing"
+	"time"
+)
+
+// seedDirectoryMeta puts path's DocumentMeta straight into lruDirectoryCache,
+// the same cache directoryMeta consults before falling back to a live
+// getDirectory query - letting ancestorChain/record be tested without a
+// running ArangoDB.
+func seedDirectoryMeta(t *testing.T, path, key string) {
+	t.Helper()
+	meta := driver.DocumentMeta{ID: driver.DocumentID("directories/" + key), Key: key}
+	lruDirectoryCache.Set(path, &meta, time.Hour)
+}
+
+func TestAncestorChainWalksUpToFirstUnresolvedAncestor(t *testing.T) {
+	seedDirectoryMeta(t, "/a/b", "bKey")
+	seedDirectoryMeta(t, "/a", "aKey")
+	// "/" is deliberately left unseeded, so the chain must stop there
+	// instead of erroring.
+
+	got := ancestorChain("/a/b/c")
+	want := []string{"bKey", "aKey"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAncestorChainEmptyWhenRootUnresolved(t *testing.T) {
+	got := ancestorChain("/unseeded/leaf")
+	if len(got) != 0 {
+		t.Fatalf("expected no ancestors, got %v", got)
+	}
+}
+
+func TestCategoryRollupRecordUpdatesOwnAndSubtreeForEveryAncestor(t *testing.T) {
+	seedDirectoryMeta(t, "/x", "xKey")
+
+	r := newCategoryRollup()
+	delta := NewCategories()
+	delta.CategorizeFile(&time.Time{}, 1024)
+
+	r.record("leafKey", "/x/leaf", delta.CategoriesDto)
+
+	if r.own["leafKey"].TotalSize != delta.TotalSize {
+		t.Fatalf("own[leafKey].TotalSize = %d, want %d", r.own["leafKey"].TotalSize, delta.TotalSize)
+	}
+	if r.subtree["leafKey"].TotalSize != delta.TotalSize {
+		t.Fatalf("subtree[leafKey].TotalSize = %d, want %d", r.subtree["leafKey"].TotalSize, delta.TotalSize)
+	}
+	if r.subtree["xKey"].TotalSize != delta.TotalSize {
+		t.Fatalf("subtree[xKey].TotalSize = %d, want %d (ancestor roll-up missing)", r.subtree["xKey"].TotalSize, delta.TotalSize)
+	}
+	if _, ok := r.own["xKey"]; ok {
+		t.Fatalf("own[xKey] should not be touched by a leaf's delta")
+	}
+}
+
+func TestCategoryRollupRecordFlushesAtCount(t *testing.T) {
+	r := newCategoryRollup()
+	delta := NewCategories()
+	delta.CategorizeFile(&time.Time{}, 1)
+
+	flushed := false
+	for i := 0; i < CategoryFlushCount; i++ {
+		flushed = r.record("leafKey", "/unseeded", delta.CategoriesDto)
+	}
+	if !flushed {
+		t.Fatalf("expected record to report a flush after %d calls", CategoryFlushCount)
+	}
+	if r.pending != 0 {
+		t.Fatalf("pending = %d, want 0 after reporting a flush", r.pending)
+	}
+}
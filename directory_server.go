@@ -31,6 +31,8 @@ type DirectoryServer struct {
 	fileHandlerChannel        chan FileHandlerPayload
 	filePayloadChannel        chan FileHandlerPayload
 	stopChannel               chan struct{}
+	categoryStopChannel       chan struct{}
+	fileBatchStopChannel      chan struct{}
 	running                   bool
 	m                         sync.Mutex
 	lastEmittedUpdateTime     time.Time
@@ -39,6 +41,10 @@ type DirectoryServer struct {
 	totalDirectoriesProcessed uint64
 	totalFilesProcessed       uint64
 	filesProcessed            float64
+	currentPath               string
+	categories                *categoryRollup
+	fileBatch                 *fileBatcher
+	workersWg                 sync.WaitGroup
 }
 
 var (
@@ -54,10 +60,13 @@ func init() {
 
 func GetDirectoryServer() *DirectoryServer {
 	directoryServerOnce.Do(func() {
+		categories := newCategoryRollup()
 		directoryServerInstance = &DirectoryServer{
 			fileHandlerChannel:        make(chan FileHandlerPayload, ChannelSize),
 			filePayloadChannel:        make(chan FileHandlerPayload, ParallelFilePayload*10),
 			stopChannel:               make(chan struct{}),
+			categoryStopChannel:       make(chan struct{}),
+			fileBatchStopChannel:      make(chan struct{}),
 			running:                   false,
 			lastEmittedUpdateTime:     time.Now(),
 			lastEmittedWarningTime:    time.Now(),
@@ -65,6 +74,8 @@ func GetDirectoryServer() *DirectoryServer {
 			totalDirectoriesProcessed: 0,
 			totalFilesProcessed:       0,
 			filesProcessed:            0,
+			categories:                categories,
+			fileBatch:                 newFileBatcher(categories),
 		}
 	})
 	return directoryServerInstance
@@ -76,28 +87,80 @@ func (ds *DirectoryServer) Start() {
 	if !ds.running {
 		ds.running = true
 		go listen(ds)
+		go ds.categories.runFlushLoop(ds.categoryStopChannel)
+		go ds.fileBatch.runFlushLoop(ds.fileBatchStopChannel)
+		ds.workersWg.Add(ParallelFilePayload)
 		for i := 0; i < ParallelFilePayload; i++ {
-			go processFilePayload(ds)
+			go func() {
+				defer ds.workersWg.Done()
+				processFilePayload(ds)
+			}()
 		}
 		return
 	}
 }
 
+// Stop drains the whole pipeline before returning: it signals listen to
+// stop accepting new work, which closes filePayloadChannel once
+// fileHandlerChannel is drained; waits for every processFilePayload worker
+// to finish (which only happens once filePayloadChannel is closed and
+// empty); and only then stops the category/file-batch flush loops, so their
+// final forced flush sees every record the workers produced rather than
+// racing them.
+//
+// ds.m is only held long enough to flip running - it must not be held
+// across workersWg.Wait(), since every processFilePayload worker locks ds.m
+// at the top of each loop iteration; holding it here while waiting on those
+// same workers to finish would deadlock.
 func (ds *DirectoryServer) Stop() {
 	ds.m.Lock()
-	defer ds.m.Unlock()
-	if ds.running {
-		ds.running = false
-		ds.stopChannel <- struct{}{}
+	if !ds.running {
+		ds.m.Unlock()
 		return
 	}
+	ds.running = false
+	ds.m.Unlock()
+
+	ds.stopChannel <- struct{}{}
+	ds.workersWg.Wait()
+	ds.categoryStopChannel <- struct{}{}
+	ds.fileBatchStopChannel <- struct{}{}
 }
 
 func (ds *DirectoryServer) GetFileHandlerPayloadChannel() chan FileHandlerPayload {
 	return ds.fileHandlerChannel
 }
 
+// Progress is a point-in-time snapshot of the server's counters, used by
+// the /stream endpoint so an operator can watch an in-flight scan.
+type Progress struct {
+	FilesProcessed       uint64  `json:"filesProcessed"`
+	DirectoriesProcessed uint64  `json:"directoriesProcessed"`
+	FilesPerSecond       float64 `json:"filesPerSecond"`
+	CurrentPath          string  `json:"currentPath"`
+}
+
+func (ds *DirectoryServer) Progress() Progress {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+	elapsed := time.Since(ds.lastEmittedUpdateTime).Seconds()
+	filesPerSecond := 0.0
+	if elapsed > 0 {
+		filesPerSecond = ds.filesProcessed / elapsed
+	}
+	return Progress{
+		FilesProcessed:       ds.totalFilesProcessed,
+		DirectoriesProcessed: ds.totalDirectoriesProcessed,
+		FilesPerSecond:       filesPerSecond,
+		CurrentPath:          ds.currentPath,
+	}
+}
+
+// listen closes filePayloadChannel on its way out, however it returns, so
+// that the processFilePayload workers ranging over it are guaranteed to
+// stop once (and only once) no more file payloads can arrive.
 func listen(ds *DirectoryServer) {
+	defer close(ds.filePayloadChannel)
 	for {
 		channelElements := len(ds.fileHandlerChannel)
 
@@ -135,11 +198,11 @@ func logUpdateIfNecessary(ds *DirectoryServer, filePayload FileHandlerPayload, c
 
 func processFilePayload(ds *DirectoryServer) {
 
-	for {
-		filePayload := <-ds.filePayloadChannel
+	for filePayload := range ds.filePayloadChannel {
 		ds.m.Lock()
 		ds.totalFilesProcessed++
 		ds.filesProcessed++
+		ds.currentPath = filePayload.FullPath
 		ds.m.Unlock()
 
 		var parentDirectoryMeta driver.DocumentMeta
@@ -147,7 +210,7 @@ func processFilePayload(ds *DirectoryServer) {
 		if value == nil {
 			var parentDirectory Directory
 			var err error
-			parentDirectory, parentDirectoryMeta, err = getDirectory(filepath.Dir(filePayload.FullPath))
+			parentDirectory, parentDirectoryMeta, err = getDirectory(nil, filepath.Dir(filePayload.FullPath))
 			if err != nil {
 				parentDirectory = Directory{Path: filepath.Dir(filePayload.FullPath)}
 				parentDirectoryMeta, err = directories.CreateDocument(nil, parentDirectory)
@@ -162,33 +225,44 @@ func processFilePayload(ds *DirectoryServer) {
 		}
 
 		file := File{Name: filePayload.FullPath, FileSize: filePayload.FileInfo.Size(), Modified: filePayload.FileInfo.ModTime()}
-		fileMeta, err := fileobjects.CreateDocument(nil, file)
-		if err != nil {
-			log.Printf("failed creating file %v: %v\n", file, err)
-			return
+
+		delta := NewCategories()
+		delta.CategorizeFile(&file.Modified, file.FileSize)
+
+		// The category delta is applied by upsertFileBatch, not here: only
+		// it can tell whether this file is a genuine new insert or a no-op
+		// re-upsert of something already counted, and applying it eagerly
+		// here would double-count every file on a rescan.
+		entry := fileBatchEntry{
+			file:       file,
+			parentKey:  parentDirectoryMeta.Key,
+			parentPath: filepath.Dir(filePayload.FullPath),
+			delta:      delta.CategoriesDto,
 		}
-		edge := Contains{"directories/" + parentDirectoryMeta.Key, "fileobjects/" + fileMeta.Key}
-		_, err = edges.CreateDocument(nil, edge)
-		if err != nil {
-			log.Printf("failed creating edge %#v: %v\n", edge, err)
-			return
+		if ds.fileBatch.add(entry) {
+			go ds.fileBatch.flush()
 		}
 	}
 }
 
 func processDirectoryPayload(ds *DirectoryServer, filePayload FileHandlerPayload) {
+	ds.m.Lock()
 	ds.totalDirectoriesProcessed++
+	ds.currentPath = filePayload.FullPath
+	ds.m.Unlock()
 	created := false
 
-	currentDirectory, currentDirectoryMeta, err := getDirectory(filePayload.FullPath)
+	currentDirectory, currentDirectoryMeta, err := getDirectory(nil, filePayload.FullPath)
 	if err != nil {
-		currentDirectory = Directory{Path: filePayload.FullPath}
+		currentDirectory = Directory{Path: filePayload.FullPath, Mtime: filePayload.FileInfo.ModTime()}
 		currentDirectoryMeta, err = directories.CreateDocument(nil, currentDirectory)
 		if err != nil {
 			log.Printf("failed creating  directory %#v: %v\n", currentDirectory, err)
 			return
 		}
 		created = true
+	} else if incrementalScan {
+		updateDirectoryCache(currentDirectory, currentDirectoryMeta, filePayload.FullPath, filePayload.FileInfo)
 	}
 	lruDirectoryCache.Set(filePayload.FullPath, &currentDirectoryMeta, time.Hour*24)
 
@@ -197,7 +271,7 @@ func processDirectoryPayload(ds *DirectoryServer, filePayload FileHandlerPayload
 
 	value := lruDirectoryCache.Get(parent)
 	if value == nil {
-		_, parentDirectoryMeta, err = getDirectory(parent)
+		_, parentDirectoryMeta, err = getDirectory(nil, parent)
 	} else {
 		parentDirectoryMeta = *(value.Value().(*driver.DocumentMeta))
 	}
@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+package fastwalk
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// rawDirEntry is the subset of information fastwalk needs about a directory
+// entry that getdents64 already gives us for free, before any lstat(2)
+// call: its name and, usually, whether it is a directory, a symlink, or
+// something else.
+type rawDirEntry struct {
+	name      string
+	isDir     bool
+	isSymlink bool
+	unknown   bool // d_type was DT_UNKNOWN, caller must lstat to be sure
+}
+
+// readRawDirEntries reads the entries of dir using the getdents64 syscall
+// directly (via syscall.ReadDirent), so that directories can usually be
+// told apart from everything else using the kernel-supplied d_type field,
+// without an extra lstat(2) round trip per entry.
+func readRawDirEntries(dir string) ([]rawDirEntry, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fd := int(f.Fd())
+	buf := make([]byte, 64*1024)
+	var entries []rawDirEntry
+
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			return entries, err
+		}
+		if n <= 0 {
+			break
+		}
+		entries = append(entries, parseDirents(buf[:n])...)
+	}
+	return entries, nil
+}
+
+// linux_dirent64 (see getdents64(2)):
+//
+//	uint64 d_ino
+//	int64  d_off
+//	uint16 d_reclen
+//	uint8  d_type
+//	char   d_name[]
+const direntHeaderSize = 19 // offsetof(d_name) in linux_dirent64
+
+func parseDirents(buf []byte) []rawDirEntry {
+	var entries []rawDirEntry
+	off := 0
+	for off+direntHeaderSize <= len(buf) {
+		reclen := *(*uint16)(unsafe.Pointer(&buf[off+16]))
+		if reclen == 0 || off+int(reclen) > len(buf) {
+			break
+		}
+		dType := buf[off+18]
+		nameBuf := buf[off+direntHeaderSize : off+int(reclen)]
+		end := 0
+		for end < len(nameBuf) && nameBuf[end] != 0 {
+			end++
+		}
+		name := string(nameBuf[:end])
+		off += int(reclen)
+
+		if name == "." || name == ".." {
+			continue
+		}
+		switch dType {
+		case syscall.DT_DIR:
+			entries = append(entries, rawDirEntry{name: name, isDir: true})
+		case syscall.DT_LNK:
+			entries = append(entries, rawDirEntry{name: name, isSymlink: true})
+		case syscall.DT_UNKNOWN:
+			entries = append(entries, rawDirEntry{name: name, unknown: true})
+		default:
+			entries = append(entries, rawDirEntry{name: name})
+		}
+	}
+	return entries
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package fastwalk
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+// appendDirent appends one linux_dirent64 record (see getdents64(2)) for
+// name/dType to buf, mirroring exactly what the kernel would hand
+// readRawDirEntries - no alignment padding after d_name, since parseDirents
+// only ever trusts d_reclen to find the next record, never an assumed
+// stride.
+func appendDirent(buf []byte, name string, dType byte) []byte {
+	reclen := direntHeaderSize + len(name) + 1 // +1 for the NUL terminator
+	rec := make([]byte, reclen)
+	binary.LittleEndian.PutUint64(rec[0:8], 0)  // d_ino, unused by parseDirents
+	binary.LittleEndian.PutUint64(rec[8:16], 0) // d_off, unused by parseDirents
+	binary.LittleEndian.PutUint16(rec[16:18], uint16(reclen))
+	rec[18] = dType
+	copy(rec[19:], name)
+	// rec[19+len(name)] is already zero (the NUL terminator)
+	return append(buf, rec...)
+}
+
+func TestParseDirentsSkipsDotEntries(t *testing.T) {
+	var buf []byte
+	buf = appendDirent(buf, ".", syscall.DT_DIR)
+	buf = appendDirent(buf, "..", syscall.DT_DIR)
+	buf = appendDirent(buf, "subdir", syscall.DT_DIR)
+
+	entries := parseDirents(buf)
+	if len(entries) != 1 || entries[0].name != "subdir" {
+		t.Fatalf("expected only %q, got %#v", "subdir", entries)
+	}
+}
+
+func TestParseDirentsClassifiesByType(t *testing.T) {
+	var buf []byte
+	buf = appendDirent(buf, "subdir", syscall.DT_DIR)
+	buf = appendDirent(buf, "link", syscall.DT_LNK)
+	buf = appendDirent(buf, "mystery", syscall.DT_UNKNOWN)
+	buf = appendDirent(buf, "file.txt", syscall.DT_REG)
+
+	entries := parseDirents(buf)
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d: %#v", len(entries), entries)
+	}
+
+	want := []rawDirEntry{
+		{name: "subdir", isDir: true},
+		{name: "link", isSymlink: true},
+		{name: "mystery", unknown: true},
+		{name: "file.txt"},
+	}
+	for i, w := range want {
+		if entries[i] != w {
+			t.Errorf("entry %d: got %#v, want %#v", i, entries[i], w)
+		}
+	}
+}
+
+func TestParseDirentsStopsOnTruncatedRecord(t *testing.T) {
+	var buf []byte
+	buf = appendDirent(buf, "whole", syscall.DT_REG)
+	buf = append(buf, 0, 1, 2) // a trailing partial record, too short to parse
+
+	entries := parseDirents(buf)
+	if len(entries) != 1 || entries[0].name != "whole" {
+		t.Fatalf("expected only %q, got %#v", "whole", entries)
+	}
+}
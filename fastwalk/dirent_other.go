@@ -0,0 +1,38 @@
+//go:build !linux
+// +build !linux
+
+package fastwalk
+
+import "os"
+
+// rawDirEntry mirrors the Linux variant; on platforms without a raw getdents
+// equivalent here we populate it from os.FileInfo instead.
+type rawDirEntry struct {
+	name      string
+	isDir     bool
+	isSymlink bool
+	unknown   bool
+}
+
+// readRawDirEntries falls back to os.File.Readdir, which on most platforms
+// (e.g. via FindFirstFile/FindNextFile on Windows) already batches the
+// per-entry metadata lookup. Only each entry's name and type are kept from
+// it; readDir still lstats every entry afterwards to get its os.FileInfo.
+func readRawDirEntries(dir string) ([]rawDirEntry, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	infos, err := f.Readdir(-1)
+	entries := make([]rawDirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = rawDirEntry{
+			name:      info.Name(),
+			isDir:     info.IsDir(),
+			isSymlink: info.Mode()&os.ModeSymlink != 0,
+		}
+	}
+	return entries, err
+}
@@ -0,0 +1,325 @@
+// Package fastwalk implements a parallel directory walker used by the scan
+// pipeline to feed entries into DirectoryServer much faster than
+// filepath.Walk can on trees with many small directories: it reads
+// directories concurrently on a pool of workers and never sorts a
+// directory's children. Entries are classified using the kernel-supplied
+// entry type wherever the platform provides one, but every entry is still
+// lstat-ed once, since VisitFunc hands callers an os.FileInfo (size and
+// ModTime) for each entry.
+package fastwalk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// SkipDir is used as a return value from VisitFunc to indicate that the
+// directory named in the call is to be recorded but not descended into.
+// It is not returned as an error by Walk. It mirrors filepath.SkipDir.
+var SkipDir = errors.New("fastwalk: skip this directory's children")
+
+// VisitFunc is called once for every directory and once for every file
+// discovered by Walk. For any given directory, VisitFunc is always called
+// for that directory itself before it is called for anything beneath it, so
+// a caller building a graph (a child edge needs its parent document to
+// already exist) can rely on strict directory-first ordering.
+//
+// When called for a directory, VisitFunc may return SkipDir to have that
+// directory recorded but not descended into (e.g. an incremental rescan
+// that finds the directory's mtime unchanged since the last scan).
+// Returning SkipDir for a file is treated like any other error.
+type VisitFunc func(path string, info os.FileInfo) error
+
+// FilterFunc reports whether a directory should be skipped entirely -
+// neither visited nor descended into. It is only ever called for
+// directories, e.g. to skip .git, crossed mountpoints, or anything below a
+// size threshold.
+type FilterFunc func(path string, info os.FileInfo) bool
+
+// Options configures a Walk.
+type Options struct {
+	// NumWorkers is the size of the goroutine pool reading directories
+	// concurrently. Defaults to runtime.NumCPU() when <= 0.
+	NumWorkers int
+
+	// Filter, when non-nil, is consulted for every directory before it is
+	// descended into.
+	Filter FilterFunc
+
+	// FollowSymlinks causes symlinks that resolve to directories to be
+	// walked as if they were real directories. A set of visited
+	// (device, inode) pairs is maintained so a symlink loop can never
+	// cause the same directory to be walked twice. On Windows fileKeyOf
+	// cannot identify a directory, so loops are not detected there.
+	FollowSymlinks bool
+}
+
+type dirJob struct {
+	path string
+	info os.FileInfo
+}
+
+// jobQueue is an unbounded FIFO of pending directories. A plain buffered
+// channel can't be used here: every worker both produces (enqueues
+// subdirectories it finds) and consumes from the same queue, so a bounded
+// channel can fill up while all workers are simultaneously blocked inside
+// readDir for a wide directory, with nobody left to receive - a permanent
+// deadlock. push never blocks, which rules that out.
+type jobQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []dirJob
+	closed bool
+}
+
+func newJobQueue() *jobQueue {
+	q := &jobQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *jobQueue) push(j dirJob) {
+	q.mu.Lock()
+	q.items = append(q.items, j)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// close marks the queue drained. Workers already parked in pop wake up and
+// exit once items is empty.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop blocks until a job is available, returning ok=false once the queue
+// has been closed and drained.
+func (q *jobQueue) pop() (dirJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return dirJob{}, false
+	}
+	j := q.items[0]
+	q.items = q.items[1:]
+	return j, true
+}
+
+// Walk walks the tree rooted at root, calling visit for every directory and
+// file it finds, and returns a channel that receives the first error
+// encountered by any worker (if any) and is then closed once the walk has
+// fully completed.
+func Walk(root string, visit VisitFunc, opts Options) <-chan error {
+	errc := make(chan error, 1)
+
+	numWorkers := opts.NumWorkers
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		errc <- err
+		close(errc)
+		return errc
+	}
+
+	w := &walker{
+		visit:   visit,
+		filter:  opts.Filter,
+		follow:  opts.FollowSymlinks,
+		jobs:    newJobQueue(),
+		visited: make(map[fileKey]struct{}),
+	}
+
+	if err := w.enter(root, rootInfo); err != nil {
+		errc <- err
+		close(errc)
+		return errc
+	}
+	if atomic.LoadInt64(&w.pending) == 0 {
+		// root was filtered out or skipped, so no worker will ever close jobs
+		w.jobs.close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			w.run()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		if err := w.err; err != nil {
+			errc <- err
+		}
+		close(errc)
+	}()
+
+	return errc
+}
+
+// walker holds the state shared by all workers of a single Walk call.
+type walker struct {
+	visit  VisitFunc
+	filter FilterFunc
+	follow bool
+
+	jobs    *jobQueue
+	pending int64 // directories queued or in flight; jobs closes when this hits 0
+
+	visitedMu sync.Mutex
+	visited   map[fileKey]struct{}
+
+	errOnce sync.Once
+	err     error
+}
+
+func (w *walker) setErr(err error) {
+	if err == nil {
+		return
+	}
+	w.errOnce.Do(func() { w.err = err })
+}
+
+// enter visits a directory and, if it passes the filter and has not been
+// seen before, enqueues it so its children get read by a worker.
+func (w *walker) enter(path string, info os.FileInfo) error {
+	if w.filter != nil && w.filter(path, info) {
+		return nil
+	}
+	if key, ok := fileKeyOf(info); ok {
+		w.visitedMu.Lock()
+		_, seen := w.visited[key]
+		if !seen {
+			w.visited[key] = struct{}{}
+		}
+		w.visitedMu.Unlock()
+		if seen {
+			return nil
+		}
+	}
+	if err := w.visit(path, info); err != nil {
+		if err == SkipDir {
+			return nil
+		}
+		return err
+	}
+	atomic.AddInt64(&w.pending, 1)
+	w.jobs.push(dirJob{path: path, info: info})
+	return nil
+}
+
+// run is a single worker: pull directories off jobs, read them, enqueue any
+// subdirectories and emit files directly.
+func (w *walker) run() {
+	for {
+		j, ok := w.jobs.pop()
+		if !ok {
+			return
+		}
+		w.readDir(j)
+		if atomic.AddInt64(&w.pending, -1) == 0 {
+			w.jobs.close()
+		}
+	}
+}
+
+func (w *walker) readDir(j dirJob) {
+	entries, err := readRawDirEntries(j.path)
+	if err != nil {
+		w.setErr(err)
+		return
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(j.path, e.name)
+
+		switch {
+		case e.isDir:
+			// Like files, directories are always lstat-ed: callers (e.g.
+			// an incremental rescan) need a real ModTime to tell whether a
+			// directory changed since the last scan, and the kernel-supplied
+			// d_type only tells us it's a directory, not when it was touched.
+			info, err := os.Lstat(path)
+			if err != nil {
+				w.setErr(err)
+				continue
+			}
+			if err := w.enter(path, info); err != nil {
+				w.setErr(err)
+			}
+		case e.isSymlink:
+			w.visitSymlink(path)
+		case e.unknown:
+			w.visitUnknown(path)
+		default:
+			info, err := os.Lstat(path)
+			if err != nil {
+				w.setErr(err)
+				continue
+			}
+			if err := w.visit(path, info); err != nil {
+				w.setErr(err)
+			}
+		}
+	}
+}
+
+// visitSymlink resolves a symlink entry. When FollowSymlinks is set and it
+// points at a directory, it is walked like any other directory (with
+// device/inode loop protection via enter); otherwise it is emitted as a
+// leaf entry, matching filepath.Walk's default behaviour.
+func (w *walker) visitSymlink(path string) {
+	if w.follow {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			if err := w.enter(path, info); err != nil {
+				w.setErr(err)
+			}
+			return
+		}
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		w.setErr(err)
+		return
+	}
+	if err := w.visit(path, info); err != nil {
+		w.setErr(err)
+	}
+}
+
+// visitUnknown handles the rare case where the platform could not tell us
+// the entry's type up front (d_type == DT_UNKNOWN on some filesystems), by
+// falling back to a single lstat to find out what the entry actually is.
+func (w *walker) visitUnknown(path string) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		w.setErr(err)
+		return
+	}
+	if info.IsDir() {
+		if err := w.enter(path, info); err != nil {
+			w.setErr(err)
+		}
+		return
+	}
+	if err := w.visit(path, info); err != nil {
+		w.setErr(err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package fastwalk
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileKey identifies a directory by device and inode, used to detect
+// symlink loops when FollowSymlinks is enabled.
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+func fileKeyOf(info os.FileInfo) (fileKey, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(stat.Dev), ino: stat.Ino}, true
+}
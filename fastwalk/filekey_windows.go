@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package fastwalk
+
+import "os"
+
+// fileKey identifies a directory for symlink-loop detection. Windows has no
+// equally cheap device/inode pair available off os.FileInfo, so loop
+// detection is disabled there; FollowSymlinks should be used sparingly on
+// this platform.
+type fileKey struct{}
+
+func fileKeyOf(info os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
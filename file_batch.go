@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchSize is how many files a worker accumulates before an
+	// early flush, ahead of the periodic DefaultFlushInterval tick.
+	DefaultBatchSize = 256
+	// DefaultFlushInterval bounds how long a file can sit unwritten when
+	// ingest is too slow to fill a batch on its own.
+	DefaultFlushInterval = 250 * time.Millisecond
+)
+
+var (
+	// BatchSize and FlushInterval are package-level so they can be set
+	// once from the -batch-size/-flush-interval flags before the
+	// DirectoryServer starts.
+	BatchSize     = DefaultBatchSize
+	FlushInterval = DefaultFlushInterval
+)
+
+type fileBatchEntry struct {
+	file       File
+	parentKey  string
+	parentPath string
+	delta      CategoriesDto
+}
+
+// fileBatcher accumulates files waiting to be upserted into fileobjects and
+// their contains edges, so a burst of ingest pays the ArangoDB round trip
+// once per batch instead of twice per file. It is shared across every
+// processFilePayload worker so DirectoryServer.Stop can drain exactly one
+// batch on shutdown regardless of which worker was mid-batch.
+//
+// It also owns applying each entry's category delta, rather than leaving
+// that to processFilePayload: whether a file is a genuine new insert (and
+// so should contribute to OwnCategories/SubtreeCategories) or just a
+// no-op re-upsert of something already counted can only be known once the
+// UPSERT itself has run, which happens here.
+type fileBatcher struct {
+	mu         sync.Mutex
+	entries    []fileBatchEntry
+	categories *categoryRollup
+}
+
+func newFileBatcher(categories *categoryRollup) *fileBatcher {
+	return &fileBatcher{entries: make([]fileBatchEntry, 0, BatchSize), categories: categories}
+}
+
+// add appends entry to the batch and reports whether it just reached
+// BatchSize and should be flushed.
+func (b *fileBatcher) add(entry fileBatchEntry) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = append(b.entries, entry)
+	return len(b.entries) >= BatchSize
+}
+
+// flush upserts every currently queued entry and clears the batch.
+func (b *fileBatcher) flush() {
+	b.mu.Lock()
+	entries := b.entries
+	b.entries = make([]fileBatchEntry, 0, BatchSize)
+	b.mu.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+	upsertFileBatch(b.categories, entries)
+}
+
+// runFlushLoop flushes b on every tick until stop is signalled, at which
+// point it flushes once more so a partial batch is never silently dropped.
+func (b *fileBatcher) runFlushLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-stop:
+			b.flush()
+			return
+		}
+	}
+}
+
+// upsertFileBatch writes a whole batch of files and their contains edges in
+// two round trips total: one bulk AQL UPSERT keyed on name for fileobjects,
+// and one bulk AQL UPSERT keyed on _from+_to for edges. UPSERT makes
+// re-running (or resuming after a crash) a scan over the same tree update
+// documents in place instead of duplicating them - and because the first
+// query reports OLD == null for each file that was a genuine insert rather
+// than a no-op update of an already-known file, categories only records a
+// delta for files actually new to fileobjects, so rerunning a scan never
+// double-counts a file's buckets.
+func upsertFileBatch(categories *categoryRollup, entries []fileBatchEntry) {
+	files := make([]File, len(entries))
+	for i, e := range entries {
+		files[i] = e.file
+	}
+
+	query := `
+FOR f IN @files
+  UPSERT { name: f.name }
+  INSERT f
+  UPDATE { size: f.size, created: f.created }
+  IN fileobjects
+  RETURN { key: NEW._key, name: f.name, inserted: OLD == null }
+`
+	cursor, err := db.Query(nil, query, map[string]interface{}{"files": files})
+	if err != nil {
+		log.Printf("failed upserting file batch (%d files): %v\n", len(files), err)
+		return
+	}
+
+	keyByName := make(map[string]string, len(files))
+	insertedByName := make(map[string]bool, len(files))
+	for cursor.HasMore() {
+		var row struct {
+			Key      string `json:"key"`
+			Name     string `json:"name"`
+			Inserted bool   `json:"inserted"`
+		}
+		if _, err := cursor.ReadDocument(nil, &row); err != nil {
+			log.Printf("failed reading upserted file: %v\n", err)
+			continue
+		}
+		keyByName[row.Name] = row.Key
+		insertedByName[row.Name] = row.Inserted
+	}
+	_ = cursor.Close()
+
+	edgeDocs := make([]Contains, 0, len(entries))
+	for _, e := range entries {
+		key, ok := keyByName[e.file.Name]
+		if !ok {
+			log.Printf("file %v missing from upsert result, skipping its edge\n", e.file.Name)
+			continue
+		}
+		edgeDocs = append(edgeDocs, Contains{
+			From: "directories/" + e.parentKey,
+			To:   "fileobjects/" + key,
+		})
+
+		if insertedByName[e.file.Name] && categories.record(e.parentKey, e.parentPath, e.delta) {
+			go categories.flush()
+		}
+	}
+	if len(edgeDocs) == 0 {
+		return
+	}
+
+	edgeQuery := `
+FOR e IN @edges
+  UPSERT { _from: e._from, _to: e._to }
+  INSERT e
+  UPDATE {}
+  IN contains
+`
+	edgeCursor, err := db.Query(nil, edgeQuery, map[string]interface{}{"edges": edgeDocs})
+	if err != nil {
+		log.Printf("failed upserting edge batch (%d edges): %v\n", len(edgeDocs), err)
+		return
+	}
+	_ = edgeCursor.Close()
+}
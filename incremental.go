@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/arangodb/go-driver"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// incrementalScan is set from the -incremental flag before the directory
+// server is started; when true, the scan skips re-visiting any directory
+// subtree whose mtime has not changed since it was last recorded.
+var incrementalScan bool
+
+// unchangedSinceLastScan reports whether path's subtree can be skipped
+// during an incremental scan because its mtime matches what was recorded
+// the last time it was scanned. It is the synchronous decision point
+// fastwalk needs in order to prune a directory before descending into it,
+// so a miss here (directory never seen before) must descend, not skip.
+func unchangedSinceLastScan(path string, info os.FileInfo) bool {
+	directory, _, err := getDirectory(nil, path)
+	if err != nil {
+		return false
+	}
+	return directory.Mtime.Equal(info.ModTime())
+}
+
+// updateDirectoryCache refreshes the incremental-scan bookkeeping for a
+// directory that has just been found to have changed (or is being visited
+// for the first time since ChildDirs/ChildFiles were introduced): it
+// records the directory's new mtime and immediate child listing, and
+// prunes any child directory or file that is no longer present on disk.
+//
+// This reads path directly rather than relying on payloads already in
+// flight from the walk, so it assumes path matches the real filesystem
+// location being scanned. With a non-empty -prefix, path is the prefixed
+// name rather than a real location, so the read fails and the directory's
+// bookkeeping is left unchanged.
+func updateDirectoryCache(directory Directory, meta driver.DocumentMeta, path string, info os.FileInfo) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		log.Printf("failed reading directory %v for incremental update: %v\n", path, err)
+		return
+	}
+
+	childDirs := make([]string, 0, len(entries))
+	childFiles := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			childDirs = append(childDirs, filepath.Join(path, entry.Name()))
+		} else {
+			childFiles = append(childFiles, filepath.Join(path, entry.Name()))
+		}
+	}
+
+	for _, oldChild := range directory.ChildDirs {
+		if !containsString(childDirs, oldChild) {
+			deleteDirectoryRecursive(nil, oldChild)
+		}
+	}
+	for _, oldFile := range directory.ChildFiles {
+		if !containsString(childFiles, oldFile) {
+			deleteFile(nil, oldFile)
+		}
+	}
+
+	directory.Mtime = info.ModTime()
+	directory.ChildDirs = childDirs
+	directory.ChildFiles = childFiles
+
+	if _, err := directories.UpdateDocument(nil, meta.Key, directory); err != nil {
+		log.Printf("failed updating directory cache %v: %v\n", path, err)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/LogicalChaos/arango/fastwalk"
 	"github.com/arangodb/go-driver"
 	"github.com/arangodb/go-driver/http"
 	"github.com/davecgh/go-spew/spew"
@@ -13,6 +15,13 @@ import (
 	"time"
 )
 
+// skipDirectory is the default fastwalk.FilterFunc for the scan command: it
+// keeps the ingest pipeline out of VCS metadata directories, which are
+// large, numerous, and never useful to categorize.
+func skipDirectory(path string, info os.FileInfo) bool {
+	return info.Name() == ".git"
+}
+
 type File struct {
 	Name     string    `json:"name"`
 	FileSize int64     `json:"size"`
@@ -21,6 +30,24 @@ type File struct {
 
 type Directory struct {
 	Path string `json:"path"`
+
+	// Incremental-rescan bookkeeping, populated only when -incremental is
+	// used. Mtime is the directory's own mtime as of the last scan;
+	// ChildDirs and ChildFiles are the child directory/file paths seen at
+	// that scan, compared against the current listing on the next scan to
+	// detect and prune anything removed from disk since.
+	Mtime      time.Time `json:"mtime,omitempty"`
+	ChildDirs  []string  `json:"childDirs,omitempty"`
+	ChildFiles []string  `json:"childFiles,omitempty"`
+
+	// OwnCategories is the age/size roll-up of the files directly inside
+	// this directory. SubtreeCategories additionally includes every
+	// descendant directory's files, so "-cmd=count -path=X" can read it
+	// straight off the node instead of traversing the graph. Both are
+	// kept up to date incrementally by processFilePayload/bumpDirectoryCategories
+	// rather than recomputed from scratch.
+	OwnCategories     CategoriesDto `json:"ownCategories,omitempty"`
+	SubtreeCategories CategoriesDto `json:"subtreeCategories,omitempty"`
 }
 
 type Contains struct {
@@ -46,17 +73,26 @@ func main() {
 	_, _, _ = fileobjects.EnsureHashIndex(nil, []string{"name"}, nil)
 	_, _, _ = directories.EnsureHashIndex(nil, []string{"path"}, nil)
 
-	commandPtr := flag.String("cmd", "", "truncate|clean|scan|count")
+	commandPtr := flag.String("cmd", "", "truncate|clean|scan|count|serve")
 	pathPtr := flag.String("path", "./", "path to command")
 	countPtr := flag.Int("count", 0, "run loop, adds a 3 digit suffix to prefix, only on scan")
 	startPtr := flag.Int("start", 0, "start of loop counter, only used with count")
 	prefixPtr := flag.String("prefix", "", "Prefix to add to each scan, like '/neo/scan1'")
+	workersPtr := flag.Int("workers", 0, "fastwalk worker count for scan, 0 = runtime.NumCPU()")
+	incrementalPtr := flag.Bool("incremental", false, "scan only directories whose mtime changed since the last scan")
+	batchSizePtr := flag.Int("batch-size", DefaultBatchSize, "number of files to upsert per batch during scan")
+	flushIntervalPtr := flag.Duration("flush-interval", DefaultFlushInterval, "max time a partial file batch waits before being upserted")
+	addrPtr := flag.String("addr", ":8080", "listen address, only used with serve or scan -serve")
+	servePtr := flag.Bool("serve", false, "also serve the HTTP query API (including /stream progress) while scanning")
 	flag.Parse()
+	BatchSize = *batchSizePtr
+	FlushInterval = *flushIntervalPtr
 
+	ctx := context.Background()
 	root := filepath.Join(*prefixPtr, *pathPtr)
 	switch *commandPtr {
 	case "clean":
-		deleteDirectoryRecursive(root)
+		deleteDirectoryRecursive(ctx, root)
 		break
 	case "truncate":
 		_ = edges.Truncate(nil)
@@ -64,9 +100,16 @@ func main() {
 		_ = fileobjects.Truncate(nil)
 		break
 	case "scan":
+		incrementalScan = *incrementalPtr
 		ds := GetDirectoryServer()
 		ds.Start()
 		defer ds.Stop()
+		if *servePtr {
+			// Started in the background so /stream can report this scan's
+			// progress; scan still exits when the walk itself finishes, it
+			// does not wait on the HTTP server.
+			go serve(*addrPtr, ds)
+		}
 		channel := ds.GetFileHandlerPayloadChannel()
 
 		info, err := os.Stat(*pathPtr)
@@ -95,14 +138,18 @@ func main() {
 					processDirectoryPayload(ds, FileHandlerPayload{info, path})
 				}
 			}
-			err = filepath.Walk(*pathPtr, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
+			errc := fastwalk.Walk(*pathPtr, func(path string, info os.FileInfo) error {
+				fullPath := filepath.Join(prefix, path)
+				if incrementalScan && info.IsDir() && unchangedSinceLastScan(fullPath, info) {
+					return fastwalk.SkipDir
 				}
-				channel <- FileHandlerPayload{info, filepath.Join(prefix, path)}
+				channel <- FileHandlerPayload{info, fullPath}
 				return nil
+			}, fastwalk.Options{
+				NumWorkers: *workersPtr,
+				Filter:     skipDirectory,
 			})
-			if err != nil {
+			if err := <-errc; err != nil {
 				log.Fatalf("error walking directory: %v", err)
 			}
 		}
@@ -112,25 +159,37 @@ func main() {
 		}
 		break
 	case "count":
-		categories := NewCategories()
-		fillCategories(root, categories)
-		_, _ = spew.Println(categories.CategoriesDto)
+		directory, _, err := getDirectory(ctx, root)
+		if err == nil && len(directory.SubtreeCategories.Values) > 0 {
+			_, _ = spew.Println(directory.SubtreeCategories)
+		} else {
+			categories := NewCategories()
+			fillCategories(ctx, root, categories)
+			_, _ = spew.Println(categories.CategoriesDto)
+		}
+		break
+	case "serve":
+		// serve is read-only against the graph, so it does not start the
+		// DirectoryServer's ingest workers - a serve process isn't meant to
+		// also be fed a concurrent scan in this CLI. To watch /stream during
+		// an actual scan, use "scan -serve" instead.
+		serve(*addrPtr, GetDirectoryServer())
 		break
 	default:
 		log.Fatalf("unrecognized command: %v", *commandPtr)
 	}
 }
 
-func fillCategories(root string, categories *Categories) {
+func fillCategories(ctx context.Context, root string, categories *Categories) {
 	filesFound := uint64(0)
-	_, meta, err := getDirectory(root)
+	_, meta, err := getDirectory(ctx, root)
 	if err != nil {
 		log.Fatalf("failed querying directory %v: %v", root, err)
 	}
 
 	query := "FOR v IN 0..10000 OUTBOUND @start GRAPH 'contains' FILTER IS_SAME_COLLECTION('fileobjects', v) RETURN v"
 	bindVars := map[string]interface{}{"start": meta.ID}
-	cursor, err := db.Query(nil, query, bindVars)
+	cursor, err := db.Query(ctx, query, bindVars)
 	if err != nil {
 		log.Fatalf("failed querying graph starting at %v: %v", root, err)
 	}
@@ -144,7 +203,7 @@ func fillCategories(root string, categories *Categories) {
 	file := File{}
 	for cursor.HasMore() {
 		filesFound++
-		_, err := cursor.ReadDocument(nil, &file)
+		_, err := cursor.ReadDocument(ctx, &file)
 		if err != nil {
 			log.Printf("failed to read cursor: %v\n", err)
 			continue
@@ -242,10 +301,15 @@ func setupClient() {
 	client = c
 }
 
-func getDirectory(path string) (Directory, driver.DocumentMeta, error) {
+// getDirectory looks up path's directory document. ctx is threaded through
+// so the HTTP query API (serve.go) can cancel the underlying AQL cursor
+// when its client goes away; CLI callers that run to completion unattended
+// pass context.Background(), and ingest-path callers that run inside the
+// scan pipeline keep passing nil, same as db.Query always accepted.
+func getDirectory(ctx context.Context, path string) (Directory, driver.DocumentMeta, error) {
 	query := "FOR d IN directories FILTER d.path == @name RETURN d"
 	bindVars := map[string]interface{}{"name": path}
-	cursor, err := db.Query(nil, query, bindVars)
+	cursor, err := db.Query(ctx, query, bindVars)
 	if err != nil {
 		return Directory{}, driver.DocumentMeta{}, fmt.Errorf("failed querying directory %v: %v", path, err)
 	}
@@ -256,28 +320,41 @@ func getDirectory(path string) (Directory, driver.DocumentMeta, error) {
 		return Directory{}, driver.DocumentMeta{}, fmt.Errorf("no directory %v", path)
 	}
 
-	metaParent, err := cursor.ReadDocument(nil, &directory)
+	metaParent, err := cursor.ReadDocument(ctx, &directory)
 	if err != nil {
 		return Directory{}, driver.DocumentMeta{}, fmt.Errorf("failed reading cursor: %v", err)
 	}
 	return directory, metaParent, nil
 }
 
-func deleteDirectoryRecursive(root string) {
+// deleteDirectoryRecursive removes root and everything beneath it: every
+// descendant directory and file vertex, and every contains edge that
+// connects them. A prior version of this only removed the directory
+// vertices, leaving every file underneath (and all the edges) dangling in
+// the graph forever - the traversal below walks vertices and their
+// incoming edge together so both get cleaned up in the same pass.
+func deleteDirectoryRecursive(ctx context.Context, root string) {
 	log.Printf("deleting directory entries start %s\n", root)
-	removed := uint64(0)
+	removedDirs := uint64(0)
+	removedFiles := uint64(0)
 	defer func() {
-		log.Printf("deleting directory entries complete (%d) %s\n", removed, root)
+		log.Printf("deleting directory entries complete (%d dirs, %d files) %s\n", removedDirs, removedFiles, root)
 	}()
 
-	_, meta, err := getDirectory(root)
+	rootDirectory, meta, err := getDirectory(ctx, root)
 	if err != nil {
 		log.Fatalf("failed querying directory %v: %v", root, err)
 	}
+	if len(rootDirectory.SubtreeCategories.Values) > 0 {
+		subtractAncestorCategories(root, rootDirectory.SubtreeCategories)
+	}
 
-	query := "FOR v IN 0..10000 OUTBOUND @start GRAPH 'contains' FILTER IS_SAME_COLLECTION('directories', v) RETURN v"
+	query := `
+FOR v, e IN 0..10000 OUTBOUND @start GRAPH 'contains'
+  RETURN { key: v._key, edgeKey: e == null ? null : e._key, isDir: IS_SAME_COLLECTION('directories', v) }
+`
 	bindVars := map[string]interface{}{"start": meta.ID}
-	cursor, err := db.Query(nil, query, bindVars)
+	cursor, err := db.Query(ctx, query, bindVars)
 	if err != nil {
 		log.Fatalf("failed querying graph starting at %v: %v", root, err)
 	}
@@ -288,19 +365,85 @@ func deleteDirectoryRecursive(root string) {
 		}
 	}()
 
-	directory := Directory{}
 	for cursor.HasMore() {
-		removed++
-		meta, err := cursor.ReadDocument(nil, &directory)
-		if err != nil {
+		var row struct {
+			Key     string `json:"key"`
+			EdgeKey string `json:"edgeKey"`
+			IsDir   bool   `json:"isDir"`
+		}
+		if _, err := cursor.ReadDocument(ctx, &row); err != nil {
 			log.Printf("failed to read cursor: %v\n", err)
 			continue
 		}
-		_, err = directories.RemoveDocument(nil, meta.Key)
-		if err != nil {
-			log.Printf("failed to remove : %v\n", err)
-			continue
+
+		if row.EdgeKey != "" {
+			if _, err := edges.RemoveDocument(ctx, row.EdgeKey); err != nil {
+				log.Printf("failed to remove edge %v: %v\n", row.EdgeKey, err)
+			}
 		}
+
+		if row.IsDir {
+			if _, err := directories.RemoveDocument(ctx, row.Key); err != nil {
+				log.Printf("failed to remove directory %v: %v\n", row.Key, err)
+				continue
+			}
+			removedDirs++
+		} else {
+			if _, err := fileobjects.RemoveDocument(ctx, row.Key); err != nil {
+				log.Printf("failed to remove file %v: %v\n", row.Key, err)
+				continue
+			}
+			removedFiles++
+		}
+	}
+}
+
+// deleteFile removes path's fileobjects document and the contains edge
+// pointing to it, so a file that disappears from disk between incremental
+// scans doesn't linger in the graph forever.
+func deleteFile(ctx context.Context, path string) {
+	query := "FOR f IN fileobjects FILTER f.name == @name RETURN { key: f._key, id: f._id }"
+	cursor, err := db.Query(ctx, query, map[string]interface{}{"name": path})
+	if err != nil {
+		log.Printf("failed querying file %v for deletion: %v\n", path, err)
+		return
+	}
+	defer func() { _ = cursor.Close() }()
+
+	if !cursor.HasMore() {
+		return
+	}
+	var file struct {
+		Key string `json:"key"`
+		ID  string `json:"id"`
+	}
+	if _, err := cursor.ReadDocument(ctx, &file); err != nil {
+		log.Printf("failed reading file %v for deletion: %v\n", path, err)
+		return
+	}
+
+	edgeQuery := "FOR e IN contains FILTER e._to == @id RETURN { key: e._key }"
+	edgeCursor, err := db.Query(ctx, edgeQuery, map[string]interface{}{"id": file.ID})
+	if err != nil {
+		log.Printf("failed querying edges to %v: %v\n", path, err)
+	} else {
+		for edgeCursor.HasMore() {
+			var edge struct {
+				Key string `json:"key"`
+			}
+			if _, err := edgeCursor.ReadDocument(ctx, &edge); err != nil {
+				log.Printf("failed reading edge to %v: %v\n", path, err)
+				continue
+			}
+			if _, err := edges.RemoveDocument(ctx, edge.Key); err != nil {
+				log.Printf("failed removing edge %v: %v\n", edge.Key, err)
+			}
+		}
+		_ = edgeCursor.Close()
+	}
+
+	if _, err := fileobjects.RemoveDocument(ctx, file.Key); err != nil {
+		log.Printf("failed removing file %v: %v\n", path, err)
 	}
 }
 
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/arangodb/go-driver"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const searchPageSize = 100
+
+// serve starts the HTTP query API on addr and blocks until the server
+// stops. Every handler is given the incoming request's context, so a
+// client that disconnects or times out cancels its AQL cursor instead of
+// leaving it pinned server-side - unlike the CLI commands in main.go, which
+// run to completion unattended and pass no cancellable context.
+func serve(addr string, ds *DirectoryServer) {
+	router := mux.NewRouter()
+	router.HandleFunc("/dirs", handleDirs).Methods(http.MethodGet)
+	router.HandleFunc("/categories", handleCategories).Methods(http.MethodGet)
+	router.HandleFunc("/search", handleSearch).Methods(http.MethodGet)
+	router.HandleFunc("/stream", handleStream(ds)).Methods(http.MethodGet)
+
+	log.Printf("serving directory graph API on %s\n", addr)
+	if err := http.ListenAndServe(addr, router); err != nil {
+		log.Fatalf("http server failed: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed encoding response: %v\n", err)
+	}
+}
+
+type dirsResponse struct {
+	Directory   Directory   `json:"directory"`
+	Directories []Directory `json:"directories"`
+	Files       []File      `json:"files"`
+}
+
+// handleDirs answers GET /dirs?path=/foo with the directory document and
+// its immediate (one-hop) children, split by kind.
+func handleDirs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+
+	directory, meta, err := getDirectory(ctx, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	childDirs, err := childDirectories(ctx, meta.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	childFiles, err := childFiles(ctx, meta.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, dirsResponse{Directory: directory, Directories: childDirs, Files: childFiles})
+}
+
+func childDirectories(ctx context.Context, start driver.DocumentID) ([]Directory, error) {
+	query := "FOR v IN 1..1 OUTBOUND @start GRAPH 'contains' FILTER IS_SAME_COLLECTION('directories', v) RETURN v"
+	cursor, err := db.Query(ctx, query, map[string]interface{}{"start": start})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = cursor.Close() }()
+
+	dirs := make([]Directory, 0)
+	for cursor.HasMore() {
+		directory := Directory{}
+		if _, err := cursor.ReadDocument(ctx, &directory); err != nil {
+			log.Printf("failed reading child directory: %v\n", err)
+			continue
+		}
+		dirs = append(dirs, directory)
+	}
+	return dirs, nil
+}
+
+func childFiles(ctx context.Context, start driver.DocumentID) ([]File, error) {
+	query := "FOR v IN 1..1 OUTBOUND @start GRAPH 'contains' FILTER IS_SAME_COLLECTION('fileobjects', v) RETURN v"
+	cursor, err := db.Query(ctx, query, map[string]interface{}{"start": start})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = cursor.Close() }()
+
+	files := make([]File, 0)
+	for cursor.HasMore() {
+		file := File{}
+		if _, err := cursor.ReadDocument(ctx, &file); err != nil {
+			log.Printf("failed reading child file: %v\n", err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// handleCategories answers GET /categories?path=/foo&depth=N with the
+// aggregated CategoriesDto for the subtree rooted at path. It prefers the
+// O(1) per-directory roll-up kept by bumpDirectoryCategories and only falls
+// back to a bounded graph traversal when that roll-up hasn't been
+// populated yet (e.g. the tree was scanned before that feature existed).
+func handleCategories(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	depth := 10000
+	if raw := r.URL.Query().Get("depth"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			depth = parsed
+		}
+	}
+
+	directory, _, err := getDirectory(ctx, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if len(directory.SubtreeCategories.Values) > 0 {
+		writeJSON(w, directory.SubtreeCategories)
+		return
+	}
+
+	categories, err := aggregateCategories(ctx, path, depth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, categories.CategoriesDto)
+}
+
+func aggregateCategories(ctx context.Context, root string, depth int) (*Categories, error) {
+	_, meta, err := getDirectory(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	categories := NewCategories()
+	query := fmt.Sprintf("FOR v IN 0..%d OUTBOUND @start GRAPH 'contains' FILTER IS_SAME_COLLECTION('fileobjects', v) RETURN v", depth)
+	cursor, err := db.Query(ctx, query, map[string]interface{}{"start": meta.ID})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = cursor.Close() }()
+
+	file := File{}
+	for cursor.HasMore() {
+		if _, err := cursor.ReadDocument(ctx, &file); err != nil {
+			log.Printf("failed reading cursor: %v\n", err)
+			continue
+		}
+		categories.CategorizeFile(&file.Modified, file.FileSize)
+	}
+	return categories, nil
+}
+
+type searchResponse struct {
+	Files []File `json:"files"`
+	Next  string `json:"next,omitempty"`
+}
+
+// globToLike translates a shell-style glob (* and ?, as advertised by
+// handleSearch's "name" param) into an AQL LIKE pattern (% and _), escaping
+// any literal %, _ or \ already present in pattern so they match themselves
+// rather than being misread as LIKE wildcards.
+func globToLike(pattern string) string {
+	if pattern == "" {
+		return ""
+	}
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '\\', '%', '_':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// handleSearch answers GET /search?name=<glob>&minSize=&olderThan= with a
+// page of matching files. The name glob is applied with AQL LIKE, which the
+// hash index on name cannot serve. Pass the "next" value from a response
+// back in as "cursor" to fetch the next page.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	params := r.URL.Query()
+
+	offset, _ := strconv.Atoi(params.Get("cursor"))
+
+	var minSize int64
+	if raw := params.Get("minSize"); raw != "" {
+		minSize, _ = strconv.ParseInt(raw, 10, 64)
+	}
+
+	var olderThan string
+	if raw := params.Get("olderThan"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			http.Error(w, "olderThan must be RFC3339", http.StatusBadRequest)
+			return
+		}
+		olderThan = parsed.UTC().Format(time.RFC3339)
+	}
+
+	query := `
+FOR f IN fileobjects
+  FILTER @name == "" OR LIKE(f.name, @name, true)
+  FILTER f.size >= @minSize
+  FILTER @olderThan == "" OR f.created <= @olderThan
+  SORT f._key
+  LIMIT @offset, @limit
+  RETURN f
+`
+	bindVars := map[string]interface{}{
+		"name":      globToLike(params.Get("name")),
+		"minSize":   minSize,
+		"olderThan": olderThan,
+		"offset":    offset,
+		"limit":     searchPageSize,
+	}
+	cursor, err := db.Query(ctx, query, bindVars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = cursor.Close() }()
+
+	files := make([]File, 0, searchPageSize)
+	for cursor.HasMore() {
+		file := File{}
+		if _, err := cursor.ReadDocument(ctx, &file); err != nil {
+			log.Printf("failed reading search result: %v\n", err)
+			continue
+		}
+		files = append(files, file)
+	}
+
+	resp := searchResponse{Files: files}
+	if len(files) == searchPageSize {
+		resp.Next = strconv.Itoa(offset + searchPageSize)
+	}
+	writeJSON(w, resp)
+}
+
+// handleStream answers GET /stream with a server-sent-events feed of this
+// process's DirectoryServer progress, so an operator can watch an
+// in-flight scan (files/sec, total processed, current path).
+func handleStream(ds *DirectoryServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+				payload, err := json.Marshal(ds.Progress())
+				if err != nil {
+					log.Printf("failed encoding progress: %v\n", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}